@@ -0,0 +1,112 @@
+// Copyright 2021 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpmostree
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/pkg/rpmostree"
+	"github.com/coreos/mantle/platform"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         rpmOstreeContainerRebase,
+		ClusterSize: 1,
+		Name:        "coreos.rpmostree.rebase-container",
+		Distros:     []string{"rhcos", "fcos"},
+	})
+}
+
+// testContainerImageDir is the local OCI image directory used to exercise
+// rebasing onto a container-native (ostree-container) deployment, without
+// needing a registry to serve it from.
+const testContainerImageDir = "/var/tmp/rpmostree-container-test"
+
+// rebaseOntoTestContainer encapsulates m's currently booted commit into an
+// OCI image directory on m, and rebases m onto it directly via the
+// ostree-container "oci:" transport, so the container-bootable path can be
+// exercised without standing up a registry. It returns the image reference
+// rebased onto and the deployment that was booted before the rebase, so
+// callers can validate against it and rebase back.
+func rebaseOntoTestContainer(c cluster.TestCluster, m platform.Machine, client *rpmostree.Client) (imgref string, origBooted rpmostree.Deployment) {
+	origStatus, err := client.Status()
+	if err != nil {
+		c.Fatal(err)
+	}
+	origBooted, err = origStatus.Booted()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.MustSSH(m, fmt.Sprintf("sudo rpm-ostree compose container-encapsulate --repo=/sysroot/ostree/repo %s oci:%s", origBooted.Checksum, testContainerImageDir))
+
+	imgref = "ostree-unverified-image:oci:" + testContainerImageDir
+	if err := client.Rebase(imgref); err != nil {
+		c.Fatal(err)
+	}
+	if err := m.Reboot(); err != nil {
+		c.Fatalf("rebooting after container rebase: %v", err)
+	}
+
+	return imgref, origBooted
+}
+
+// rpmOstreeContainerRebase rebases the node onto a container image in a
+// local OCI directory and validates via the JSON status that the booted
+// deployment's container-image-reference and base commit agree with the
+// image reference and the commit that were encapsulated into it. It then
+// rebases back to the original ref, mirroring the MCO's
+// commit-hash-equivalence check for the container-bootable code path.
+func rpmOstreeContainerRebase(c cluster.TestCluster) {
+	m := c.Machines()[0]
+	client := rpmostree.NewClient(c, m)
+
+	imgref, origBooted := rebaseOntoTestContainer(c, m, client)
+
+	status, err := client.Status()
+	if err != nil {
+		c.Fatal(err)
+	}
+	booted, err := status.Booted()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	if booted.ContainerImageReference != imgref {
+		c.Fatalf(`"container-image-reference" has incorrect value: want %q, got %q`, imgref, booted.ContainerImageReference)
+	}
+	bootedBase := booted.BaseChecksum
+	if bootedBase == "" {
+		bootedBase = booted.Checksum
+	}
+	if bootedBase != origBooted.Checksum {
+		c.Fatalf("booted base checksum %q does not match the encapsulated commit %q", bootedBase, origBooted.Checksum)
+	}
+
+	// rebase back to the original ref; cleanup verifies we're left with a
+	// single deployment again
+	if err := client.Rebase(origBooted.Origin); err != nil {
+		c.Fatal(err)
+	}
+	if err := m.Reboot(); err != nil {
+		c.Fatalf("rebooting after rebasing back to %q: %v", origBooted.Origin, err)
+	}
+	if err := client.Cleanup(); err != nil {
+		c.Fatal(err)
+	}
+}
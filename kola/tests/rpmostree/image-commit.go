@@ -0,0 +1,78 @@
+// Copyright 2021 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpmostree
+
+import (
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/pkg/rpmostree"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         rpmOstreeImageCommitEquivalence,
+		ClusterSize: 1,
+		Name:        "coreos.rpmostree.image-commit-equivalence",
+		Distros:     []string{"rhcos", "fcos"},
+	})
+}
+
+// rpmOstreeImageCommitEquivalence rebases onto a container-native
+// deployment and then, the way the Machine Config Operator does,
+// independently verifies that the "ostree.commit" label embedded in the
+// booted container image matches the on-disk base commit the node
+// actually booted. This catches drift between what a node believes it's
+// running and what the image it booted actually contains.
+func rpmOstreeImageCommitEquivalence(c cluster.TestCluster) {
+	m := c.Machines()[0]
+	client := rpmostree.NewClient(c, m)
+
+	_, origBooted := rebaseOntoTestContainer(c, m, client)
+
+	status, err := client.Status()
+	if err != nil {
+		c.Fatal(err)
+	}
+	booted, err := status.Booted()
+	if err != nil {
+		c.Fatal(err)
+	}
+	if booted.ContainerImageReference == "" {
+		c.Fatalf("booted deployment has no container-image-reference to cross-check")
+	}
+
+	imageCommit, err := client.ImageOstreeCommit(booted.ContainerImageReference)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	wantCommit := booted.BaseChecksum
+	if wantCommit == "" {
+		wantCommit = booted.Checksum
+	}
+	if imageCommit != wantCommit {
+		c.Fatalf(`image "ostree.commit" label %q does not match the booted base commit %q`, imageCommit, wantCommit)
+	}
+
+	if err := client.Rebase(origBooted.Origin); err != nil {
+		c.Fatal(err)
+	}
+	if err := m.Reboot(); err != nil {
+		c.Fatalf("rebooting after rebasing back to %q: %v", origBooted.Origin, err)
+	}
+	if err := client.Cleanup(); err != nil {
+		c.Fatal(err)
+	}
+}
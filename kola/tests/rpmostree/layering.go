@@ -0,0 +1,135 @@
+// Copyright 2021 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpmostree
+
+import (
+	"strings"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/pkg/rpmostree"
+)
+
+func init() {
+	register.Register(&register.Test{
+		Run:         rpmOstreeLayering,
+		ClusterSize: 1,
+		Name:        "coreos.rpmostree.layering",
+		Distros:     []string{"rhcos", "fcos"},
+	})
+	register.Register(&register.Test{
+		Run:         rpmOstreeApplyLive,
+		ClusterSize: 1,
+		Name:        "coreos.rpmostree.apply-live",
+		Distros:     []string{"rhcos", "fcos"},
+	})
+}
+
+// testLayeredPackage is the package layered by the layering and apply-live
+// tests; it's expected to be available in the distro's repos but is not
+// part of a default install, so its presence is a reliable signal.
+const testLayeredPackage = "wget"
+
+// containsString reports whether needle is present in haystack.
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// rpmOstreeLayering exercises `rpm-ostree install`, verifying the pending
+// deployment's RequestedPackages/Packages fields, then reboots into it and
+// asserts it's booted. Finally it runs `rpm-ostree cleanup -rpmb` and
+// asserts the machine is back to a single deployment.
+func rpmOstreeLayering(c cluster.TestCluster) {
+	m := c.Machines()[0]
+	client := rpmostree.NewClient(c, m)
+
+	if err := client.Install(testLayeredPackage); err != nil {
+		c.Fatal(err)
+	}
+
+	status, err := client.Status()
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	var pending *rpmostree.Deployment
+	for i, d := range status.Deployments {
+		if !d.Booted {
+			pending = &status.Deployments[i]
+			break
+		}
+	}
+	if pending == nil {
+		c.Fatalf("no pending deployment found after rpm-ostree install")
+	}
+
+	if !containsString(pending.RequestedPackages, testLayeredPackage) {
+		c.Fatalf(`pending deployment "requested-packages" missing %q: got %v`, testLayeredPackage, pending.RequestedPackages)
+	}
+	if !containsString(pending.Packages, testLayeredPackage) {
+		c.Fatalf(`pending deployment "packages" missing %q: got %v`, testLayeredPackage, pending.Packages)
+	}
+
+	if err := m.Reboot(); err != nil {
+		c.Fatalf("rebooting into layered deployment: %v", err)
+	}
+
+	status, err = client.Status()
+	if err != nil {
+		c.Fatal(err)
+	}
+	booted, err := status.Booted()
+	if err != nil {
+		c.Fatal(err)
+	}
+	if !booted.Booted {
+		c.Fatalf("booted deployment does not report as being booted")
+	}
+	if !containsString(booted.RequestedPackages, testLayeredPackage) {
+		c.Fatalf(`booted deployment "requested-packages" missing %q: got %v`, testLayeredPackage, booted.RequestedPackages)
+	}
+
+	if err := client.Cleanup(); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// rpmOstreeApplyLive exercises `rpm-ostree apply-live`, verifying that a
+// layered package is present in the running root without a reboot.
+func rpmOstreeApplyLive(c cluster.TestCluster) {
+	m := c.Machines()[0]
+	client := rpmostree.NewClient(c, m)
+
+	if err := client.Install(testLayeredPackage); err != nil {
+		c.Fatal(err)
+	}
+
+	if err := client.ApplyLive(); err != nil {
+		c.Fatal(err)
+	}
+
+	if out, err := c.SSH(m, "rpm -q "+testLayeredPackage); err != nil {
+		c.Fatalf(`%q is not present in the live root after apply-live: %v (output: %s)`, testLayeredPackage, err, strings.TrimSpace(string(out)))
+	}
+
+	if err := client.Cleanup(); err != nil {
+		c.Fatal(err)
+	}
+}
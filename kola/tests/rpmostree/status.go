@@ -15,96 +15,59 @@
 package rpmostree
 
 import (
-	"encoding/json"
-	"fmt"
-	"regexp"
-	"strings"
-
+	"github.com/coreos/mantle/kola"
 	"github.com/coreos/mantle/kola/cluster"
 	"github.com/coreos/mantle/kola/register"
-	"github.com/coreos/mantle/platform"
+	"github.com/coreos/mantle/pkg/rpmostree"
 )
 
 func init() {
 	register.Register(&register.Test{
 		Run:         rpmOstreeStatus,
 		ClusterSize: 1,
-		Name:        "rhcos.rpmostree.status",
-		Distros:     []string{"rhcos"},
+		Name:        "coreos.rpmostree.status",
+		Distros:     []string{"rhcos", "fcos"},
 	})
 }
 
-var (
-	// hard code the osname for RHCOS
-	// TODO: should this also support FCOS?
-	rhcosOsname string = "rhcos"
-
-	// Regex to extract version number from "rpm-ostree status"
-	rpmOstreeVersionRegex string = `^Version: (\d+\.\d+\.\d+).*`
-)
-
-// rpmOstreeDeployment represents some of the data of an rpm-ostree deployment
-type rpmOstreeDeployment struct {
-	Booted            bool     `json:"booted"`
-	Checksum          string   `json:"checksum"`
-	Origin            string   `json:"origin"`
-	Osname            string   `json:"osname"`
-	Packages          []string `json:"packages"`
-	RequestedPackages []string `json:"requested-packages"`
-	Version           string   `json:"version"`
-}
-
-// simplifiedRpmOstreeStatus contains deployments from rpm-ostree status
-type simplifiedRpmOstreeStatus struct {
-	Deployments []rpmOstreeDeployment
-}
-
-// getRpmOstreeStatusJSON returns an unmarshal'ed JSON object that contains
-// a limited representation of the output of `rpm-ostree status --json`
-func getRpmOstreeStatusJSON(c cluster.TestCluster, m platform.Machine) (simplifiedRpmOstreeStatus, error) {
-	target := simplifiedRpmOstreeStatus{}
-	rpmOstreeJSON, err := c.SSH(m, "rpm-ostree status --json")
-	if err != nil {
-		return target, fmt.Errorf("Could not get rpm-ostree status: %v", err)
-	}
-
-	err = json.Unmarshal(rpmOstreeJSON, &target)
-	if err != nil {
-		return target, fmt.Errorf("Couldn't umarshal the rpm-ostree status JSON data: %v", err)
-	}
-
-	return target, nil
+// osProfile describes the rpm-ostree invariants that are expected to hold
+// for a given distro, so the same test can cross-check them on every OS
+// build that rpm-ostree targets rather than just RHCOS.
+type osProfile struct {
+	// Osname is the expected "osname" field of the booted deployment.
+	Osname string
 }
 
-// rpmOstreeCleanup calls 'rpm-ostree cleanup -rpmb' on a host and verifies
-// that only one deployment remains
-func rpmOstreeCleanup(c cluster.TestCluster, m platform.Machine) error {
-	c.MustSSH(m, "sudo rpm-ostree cleanup -rpmb")
-
-	// one last check to make sure we are back to the original state
-	cleanupStatus, err := getRpmOstreeStatusJSON(c, m)
-	if err != nil {
-		return fmt.Errorf(`Failed to get status JSON: %v`, err)
-	}
-
-	if len(cleanupStatus.Deployments) != 1 {
-		return fmt.Errorf(`Cleanup left more than one deployment`)
-	}
-	return nil
+// osProfiles maps a distro, as reported by kola.Options.Distro, to the
+// rpm-ostree invariants that should hold for it.
+var osProfiles = map[string]osProfile{
+	"rhcos": {
+		Osname: "rhcos",
+	},
+	"fcos": {
+		Osname: "fedora-coreos",
+	},
 }
 
 // rpmOstreeStatus does some sanity checks on the output from
-// `rpm-ostree status` and `rpm-ostree status --json`
+// `rpm-ostree status --json`, validated against the typed rpmostree client
+// rather than scraped from the human-readable `rpm-ostree status` output.
 func rpmOstreeStatus(c cluster.TestCluster) {
 	m := c.Machines()[0]
 
+	profile, ok := osProfiles[kola.Options.Distro]
+	if !ok {
+		c.Fatalf("no rpm-ostree os profile registered for distro %q", kola.Options.Distro)
+	}
+
 	// check that rpm-ostreed is static?
 	enabledOut := c.MustSSH(m, "systemctl is-enabled rpm-ostreed")
 	if string(enabledOut) != "static" {
 		c.Fatalf(`The "rpm-ostreed" service is not "static": got %v`, string(enabledOut))
 	}
 
-	status, err := getRpmOstreeStatusJSON(c, m)
+	client := rpmostree.NewClient(c, m)
+	status, err := client.Status()
 	if err != nil {
 		c.Fatal(err)
 	}
@@ -120,10 +83,9 @@ func rpmOstreeStatus(c cluster.TestCluster) {
 		c.Fatalf("Expected one deployment; found %d deployments", len(status.Deployments))
 	}
 
-	// the osname should only be RHCOS
-	// TODO: perhaps this should also support FCOS?
-	if status.Deployments[0].Osname != rhcosOsname {
-		c.Fatalf(`"osname" has incorrect value: want %q, got %q`, rhcosOsname, status.Deployments[0].Osname)
+	// the osname should match what's expected for this distro
+	if status.Deployments[0].Osname != profile.Osname {
+		c.Fatalf(`"osname" has incorrect value: want %q, got %q`, profile.Osname, status.Deployments[0].Osname)
 	}
 
 	// deployment should be booted (duh!)
@@ -131,27 +93,9 @@ func rpmOstreeStatus(c cluster.TestCluster) {
 		c.Fatalf(`Deployment does not report as being booted`)
 	}
 
-	// let's validate that the version from the JSON matches the normal output
-	var rpmOstreeVersion string
-	rpmOstreeStatusOut := c.MustSSH(m, "rpm-ostree status")
-	reVersion, err := regexp.Compile(rpmOstreeVersionRegex)
-	statusArray := strings.Split(string(rpmOstreeStatusOut), "\n")
-	for _, line := range statusArray {
-		versionMatch := reVersion.FindStringSubmatch(strings.Trim(line, " "))
-		if versionMatch != nil {
-			// versionMatch should be like `[Version: 4.0.5516 (2018-09-12 17:22:06) 4.0.5516]`
-			// i.e. the full match and the group we want
-			// `versionMatch[len(versionMatch)-1]` gets the last element in the array
-			rpmOstreeVersion = versionMatch[len(versionMatch)-1]
-		}
-	}
-
-	if rpmOstreeVersion == "" {
-		c.Fatalf(`Unable to determine version from "rpm-ostree status"`)
-	}
-
-	if rpmOstreeVersion != status.Deployments[0].Version {
-		c.Fatalf(`The version numbers did not match -> from JSON: %q; from stdout: %q`, status.Deployments[0].Version, rpmOstreeVersion)
-
+	// the deployment should have an origin; the exact refspec format
+	// differs by distro and arch and is not asserted here.
+	if status.Deployments[0].Origin == "" {
+		c.Fatalf(`Deployment "origin" is empty`)
 	}
 }
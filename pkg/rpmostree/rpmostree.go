@@ -0,0 +1,283 @@
+// Copyright 2021 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rpmostree provides a typed client for querying rpm-ostree state
+// on a remote test machine, mirroring the schema emitted by
+// `rpm-ostree status --json` instead of scraping the human-readable
+// `rpm-ostree status` output.
+package rpmostree
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/platform"
+)
+
+// statusAttempts is the total number of times Status will try `rpm-ostree
+// status --json` before giving up, to ride out transient failures while
+// the rpm-ostreed D-Bus service is activating.
+const statusAttempts = 5
+
+// statusRetryDelay is the initial delay between retries of
+// `rpm-ostree status --json`; it doubles after each attempt.
+const statusRetryDelay = 2 * time.Second
+
+// dbusActivationErrorSubstrings are substrings of the error rpm-ostree
+// status emits when the rpm-ostreed D-Bus service is still activating,
+// the only case Status retries. Any other failure (bad command, auth
+// failure, the unit having been renamed, etc.) is permanent and is
+// returned to the caller immediately.
+var dbusActivationErrorSubstrings = []string{
+	"Failed to activate service",
+	"The name org.projectatomic.rpmostree1 was not provided by any .service files",
+	"Message recipient disconnected from message bus without replying",
+}
+
+// isTransientStatusError reports whether err looks like one of the
+// transient D-Bus activation failures Status is meant to ride out.
+func isTransientStatusError(err error) bool {
+	msg := err.Error()
+	for _, substr := range dbusActivationErrorSubstrings {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deployment mirrors a single entry of the "deployments" array produced by
+// `rpm-ostree status --json`.
+type Deployment struct {
+	Booted                  bool                   `json:"booted"`
+	Staged                  bool                   `json:"staged"`
+	Pinned                  bool                   `json:"pinned"`
+	Unlocked                string                 `json:"unlocked"`
+	Checksum                string                 `json:"checksum"`
+	BaseChecksum            string                 `json:"base-checksum"`
+	BaseCommitMeta          map[string]interface{} `json:"base-commit-meta"`
+	ContainerImageReference string                 `json:"container-image-reference"`
+	Origin                  string                 `json:"origin"`
+	Osname                  string                 `json:"osname"`
+	Packages                []string               `json:"packages"`
+	RequestedPackages       []string               `json:"requested-packages"`
+	RequestedLocalPackages  []string               `json:"requested-local-packages"`
+	Version                 string                 `json:"version"`
+}
+
+// Status mirrors the top-level object produced by `rpm-ostree status --json`.
+type Status struct {
+	Deployments []Deployment `json:"deployments"`
+}
+
+// Booted returns the currently booted deployment, or an error if the
+// status has none.
+func (s Status) Booted() (Deployment, error) {
+	for _, d := range s.Deployments {
+		if d.Booted {
+			return d, nil
+		}
+	}
+	return Deployment{}, fmt.Errorf("no booted deployment found in rpm-ostree status")
+}
+
+// Client queries and drives rpm-ostree on a remote test machine over SSH.
+type Client struct {
+	c cluster.TestCluster
+	m platform.Machine
+}
+
+// NewClient returns a Client for driving rpm-ostree on m.
+func NewClient(c cluster.TestCluster, m platform.Machine) *Client {
+	return &Client{c: c, m: m}
+}
+
+// Status fetches and unmarshals `rpm-ostree status --json`, retrying with
+// backoff on transient D-Bus activation failures.
+func (cl *Client) Status() (Status, error) {
+	var status Status
+	var lastErr error
+
+	delay := statusRetryDelay
+	for attempt := 0; attempt < statusAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		out, err := cl.c.SSH(cl.m, "rpm-ostree status --json")
+		if err != nil {
+			lastErr = fmt.Errorf("running rpm-ostree status --json: %v", err)
+			if isTransientStatusError(err) {
+				continue
+			}
+			return Status{}, lastErr
+		}
+
+		if err := json.Unmarshal(out, &status); err != nil {
+			return Status{}, fmt.Errorf("unmarshaling rpm-ostree status JSON: %v", err)
+		}
+
+		return status, nil
+	}
+
+	return Status{}, fmt.Errorf("rpm-ostree status --json failed after %d attempts: %v", statusAttempts, lastErr)
+}
+
+// Rebase runs `rpm-ostree rebase <ref>` on the machine, switching it onto
+// ref. ref may be a traditional ostree refspec or, for container-native
+// deployments, an ostree-container transport reference such as
+// "ostree-unverified-registry:quay.io/example/os:latest".
+func (cl *Client) Rebase(ref string) error {
+	if _, err := cl.c.SSH(cl.m, fmt.Sprintf("sudo rpm-ostree rebase %s", ref)); err != nil {
+		return fmt.Errorf("running rpm-ostree rebase %s: %v", ref, err)
+	}
+	return nil
+}
+
+// Install runs `rpm-ostree install <pkgs...>` on the machine, layering
+// pkgs onto a new pending deployment.
+func (cl *Client) Install(pkgs ...string) error {
+	cmd := fmt.Sprintf("sudo rpm-ostree install %s", strings.Join(pkgs, " "))
+	if _, err := cl.c.SSH(cl.m, cmd); err != nil {
+		return fmt.Errorf("running %s: %v", cmd, err)
+	}
+	return nil
+}
+
+// ApplyLive runs `rpm-ostree apply-live` on the machine, applying the
+// pending deployment's package set to the running root without a reboot.
+func (cl *Client) ApplyLive() error {
+	if _, err := cl.c.SSH(cl.m, "sudo rpm-ostree apply-live"); err != nil {
+		return fmt.Errorf("running rpm-ostree apply-live: %v", err)
+	}
+	return nil
+}
+
+// ostreeRegistryTransports lists the rpm-ostree ostree-container
+// verification prefixes that wrap a plain registry pullspec with no
+// transport of its own, requiring "docker://" to be added for skopeo.
+// "ostree-remote-registry:" additionally embeds the name of the ostree
+// remote the image was pulled through (e.g.
+// "ostree-remote-registry:<remotename>:<docker-ref>"), which has no
+// meaning to skopeo and is stripped along with the prefix.
+var ostreeRegistryTransports = []string{
+	"ostree-unverified-registry:",
+	"ostree-remote-registry:",
+}
+
+// ostreeImageTransports lists the rpm-ostree ostree-container verification
+// prefixes that wrap a reference which already carries its own skopeo
+// transport, e.g. "oci:/path" or "docker://host/image".
+// "ostree-remote-image:" additionally embeds the name of the ostree
+// remote the image was pulled through (e.g.
+// "ostree-remote-image:<remotename>:<transport>:<ref>"), which has no
+// meaning to skopeo and is stripped along with the prefix.
+var ostreeImageTransports = []string{
+	"ostree-unverified-image:",
+	"ostree-image-signed:",
+	"ostree-remote-image:",
+}
+
+// ostreeRemotePrefixes are the subset of the above prefixes that embed an
+// ostree remote name as an extra ":"-delimited segment before the actual
+// reference.
+var ostreeRemotePrefixes = []string{
+	"ostree-remote-registry:",
+	"ostree-remote-image:",
+}
+
+// skopeoRef converts an rpm-ostree container-image-reference into a
+// reference skopeo understands.
+func skopeoRef(containerImageRef string) string {
+	for _, prefix := range ostreeRemotePrefixes {
+		if strings.HasPrefix(containerImageRef, prefix) {
+			rest := strings.TrimPrefix(containerImageRef, prefix)
+			if parts := strings.SplitN(rest, ":", 2); len(parts) == 2 {
+				containerImageRef = prefix + parts[1]
+			}
+			break
+		}
+	}
+	for _, transport := range ostreeRegistryTransports {
+		if strings.HasPrefix(containerImageRef, transport) {
+			return "docker://" + strings.TrimPrefix(containerImageRef, transport)
+		}
+	}
+	for _, transport := range ostreeImageTransports {
+		if strings.HasPrefix(containerImageRef, transport) {
+			return strings.TrimPrefix(containerImageRef, transport)
+		}
+	}
+	return containerImageRef
+}
+
+// skopeoImageConfig is the subset of `skopeo inspect --config` output this
+// package cares about.
+type skopeoImageConfig struct {
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// ImageOstreeCommit returns the "ostree.commit" config label embedded in
+// the container image referenced by containerImageRef (an rpm-ostree
+// container-image-reference, e.g.
+// "ostree-unverified-image:oci:/var/tmp/example" or
+// "ostree-unverified-registry:quay.io/example/os:latest"), as reported by
+// running `skopeo inspect --config` on the test machine. This mirrors the
+// MCO's approach of cross-checking the image a node believes it's running
+// against what the registry actually serves.
+func (cl *Client) ImageOstreeCommit(containerImageRef string) (string, error) {
+	ref := skopeoRef(containerImageRef)
+
+	cmd := fmt.Sprintf("skopeo inspect --config --tls-verify=false %s", ref)
+	out, err := cl.c.SSH(cl.m, cmd)
+	if err != nil {
+		return "", fmt.Errorf("inspecting %s for ostree.commit label: %v", containerImageRef, err)
+	}
+
+	var cfg skopeoImageConfig
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		return "", fmt.Errorf("unmarshaling skopeo inspect --config output for %s: %v", containerImageRef, err)
+	}
+
+	commit, ok := cfg.Config.Labels["ostree.commit"]
+	if !ok || commit == "" {
+		return "", fmt.Errorf("image %s has no ostree.commit label", containerImageRef)
+	}
+	return commit, nil
+}
+
+// Cleanup runs `rpm-ostree cleanup -rpmb` on the machine and verifies that
+// only one deployment remains afterwards.
+func (cl *Client) Cleanup() error {
+	if _, err := cl.c.SSH(cl.m, "sudo rpm-ostree cleanup -rpmb"); err != nil {
+		return fmt.Errorf("running rpm-ostree cleanup -rpmb: %v", err)
+	}
+
+	status, err := cl.Status()
+	if err != nil {
+		return err
+	}
+
+	if len(status.Deployments) != 1 {
+		return fmt.Errorf("cleanup left %d deployments, expected 1", len(status.Deployments))
+	}
+
+	return nil
+}